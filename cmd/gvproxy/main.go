@@ -0,0 +1,117 @@
+// Command gvproxy runs a tap.LinkEndpoint as a standalone host-side switch:
+// guests connect to --listen-network/--listen-address and the endpoint
+// bridges their traffic, optionally capturing it to a pcap file and/or
+// auto-configuring guests via a built-in DHCP server.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+
+	"github.com/djs55/gvisor-tap-vsock/pkg/tap"
+)
+
+func main() {
+	var (
+		listenNetwork = flag.String("listen-network", "unix", "network guests connect over: unix or tcp")
+		listenAddress = flag.String("listen-address", "/tmp/gvproxy.sock", "address or path guests connect to")
+		mac           = flag.String("mac", "5a:94:ef:e4:0c:dd", "MAC address the endpoint identifies itself with")
+		mtu           = flag.Int("mtu", 1500, "maximum transmission unit")
+		batchSize     = flag.Int("batch-size", 16, "number of packets to coalesce per read/write syscall")
+		debug         = flag.Bool("debug", false, "log every frame seen by the endpoint")
+
+		pcapPath = flag.String("pcap", "", "capture all traffic to this file in pcap format (empty disables capture)")
+
+		dhcpEnable   = flag.Bool("dhcp", false, "run a built-in DHCP server leasing addresses to connecting guests")
+		dhcpRange    = flag.String("dhcp-range", "192.168.127.2,192.168.127.254", "start,end of the DHCP lease pool")
+		dhcpServerIP = flag.String("dhcp-server-ip", "192.168.127.1", "address the DHCP server identifies itself with, and the default gateway it offers")
+		dhcpNetmask  = flag.String("dhcp-netmask", "255.255.255.0", "subnet mask offered to DHCP clients")
+	)
+	flag.Parse()
+
+	if err := run(*listenNetwork, *listenAddress, *mac, *mtu, *batchSize, *debug, *pcapPath, *dhcpEnable, *dhcpRange, *dhcpServerIP, *dhcpNetmask); err != nil {
+		log.Exit(err)
+	}
+}
+
+func run(listenNetwork, listenAddress, mac string, mtu, batchSize int, debug bool, pcapPath string, dhcpEnable bool, dhcpRange, dhcpServerIP, dhcpNetmask string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return errors.Wrapf(err, "invalid -mac %q", mac)
+	}
+
+	l, err := net.Listen(listenNetwork, listenAddress)
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen on %s:%s", listenNetwork, listenAddress)
+	}
+	log.Infof("listening on %s:%s", listenNetwork, listenAddress)
+
+	e := &tap.LinkEndpoint{
+		Listener:            l,
+		Debug:               debug,
+		Mac:                 tcpip.LinkAddress(hw),
+		MaxTransmissionUnit: mtu,
+		BatchSize:           batchSize,
+	}
+
+	if pcapPath != "" {
+		f, err := os.Create(pcapPath)
+		if err != nil {
+			return errors.Wrapf(err, "cannot create -pcap file %q", pcapPath)
+		}
+		defer f.Close()
+
+		h, err := tap.NewPCAPWriter(f)
+		if err != nil {
+			return errors.Wrap(err, "cannot start pcap capture")
+		}
+		e.AddPacketHandler(0, h)
+		log.Infof("capturing traffic to %s", pcapPath)
+	}
+
+	if dhcpEnable {
+		start, end, err := parseDHCPRange(dhcpRange)
+		if err != nil {
+			return errors.Wrapf(err, "invalid -dhcp-range %q", dhcpRange)
+		}
+		config := tap.DHCPConfig{
+			ServerIP:   net.ParseIP(dhcpServerIP),
+			RangeStart: start,
+			RangeEnd:   end,
+			Netmask:    net.IPMask(net.ParseIP(dhcpNetmask).To4()),
+		}
+		if config.ServerIP == nil {
+			return errors.Errorf("invalid -dhcp-server-ip %q", dhcpServerIP)
+		}
+		if _, err := tap.NewDHCPServer(e, config); err != nil {
+			return errors.Wrap(err, "cannot start DHCP server")
+		}
+		log.Infof("DHCP server leasing %s-%s", start, end)
+	}
+
+	return e.AcceptOne()
+}
+
+// parseDHCPRange splits a "start,end" pair of dotted-quad addresses as
+// accepted by -dhcp-range.
+func parseDHCPRange(s string) (start, end net.IP, err error) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("expected \"start,end\"")
+	}
+	start = net.ParseIP(parts[0])
+	if start == nil {
+		return nil, nil, errors.Errorf("invalid start address %q", parts[0])
+	}
+	end = net.ParseIP(parts[1])
+	if end == nil {
+		return nil, nil, errors.Errorf("invalid end address %q", parts[1])
+	}
+	return start, end, nil
+}
@@ -0,0 +1,485 @@
+package tap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpBootRequest = 1
+	dhcpBootReply   = 2
+
+	dhcpMagicCookie = 0x63825363
+
+	dhcpFlagBroadcast = 0x8000
+
+	broadcastMAC = "\xff\xff\xff\xff\xff\xff"
+)
+
+type dhcpMessageType byte
+
+const (
+	dhcpDiscover dhcpMessageType = 1
+	dhcpOffer    dhcpMessageType = 2
+	dhcpRequest  dhcpMessageType = 3
+	dhcpDecline  dhcpMessageType = 4
+	dhcpAck      dhcpMessageType = 5
+	dhcpNak      dhcpMessageType = 6
+	dhcpRelease  dhcpMessageType = 7
+	dhcpInform   dhcpMessageType = 8
+)
+
+const (
+	optSubnetMask  = 1
+	optRouter      = 3
+	optDNSServer   = 6
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optEnd         = 255
+)
+
+// DHCPConfig configures a DHCPServer.
+type DHCPConfig struct {
+	// ServerIP is the address the server identifies itself with, and the
+	// default gateway it offers unless Gateway is set.
+	ServerIP net.IP
+	// RangeStart and RangeEnd bound the pool of addresses handed out to
+	// clients, inclusive.
+	RangeStart, RangeEnd net.IP
+	// Netmask is the subnet mask offered to clients.
+	Netmask net.IPMask
+	// Gateway is the default route offered to clients. Defaults to
+	// ServerIP when nil.
+	Gateway net.IP
+	// DNS are the DNS servers offered to clients.
+	DNS []net.IP
+	// LeaseTime is how long a lease is valid for before it must be
+	// renewed. Defaults to 12 hours when zero.
+	LeaseTime time.Duration
+	// StaticHosts reserves an address for a given MAC address (formatted
+	// as net.HardwareAddr.String()), bypassing the dynamic pool.
+	StaticHosts map[string]net.IP
+}
+
+type dhcpLease struct {
+	ip      net.IP
+	mac     string
+	expires time.Time
+	static  bool
+}
+
+// DHCPServer is a minimal DHCPv4 server that leases addresses to guests
+// behind a tap.LinkEndpoint, so they don't need a static network
+// configuration baked in. It is installed as a PacketHandler, so it only
+// ever observes traffic; replies are written back through the endpoint's
+// own framing.
+type DHCPServer struct {
+	endpoint *LinkEndpoint
+	config   DHCPConfig
+	cancel   func()
+
+	mu     sync.Mutex
+	leases map[string]*dhcpLease // keyed by chaddr.String()
+	byIP   map[string]*dhcpLease // keyed by ip.String()
+}
+
+// NewDHCPServer registers a DHCPServer on e's packet handler chain. Call
+// Close to stop serving requests.
+func NewDHCPServer(e *LinkEndpoint, config DHCPConfig) (*DHCPServer, error) {
+	if config.ServerIP == nil || config.RangeStart == nil || config.RangeEnd == nil || config.Netmask == nil {
+		return nil, errors.New("dhcp: ServerIP, RangeStart, RangeEnd and Netmask are required")
+	}
+	if ip2int(config.RangeEnd) < ip2int(config.RangeStart) {
+		return nil, fmt.Errorf("dhcp: range end %s precedes range start %s", config.RangeEnd, config.RangeStart)
+	}
+	if config.Gateway == nil {
+		config.Gateway = config.ServerIP
+	}
+	if config.LeaseTime == 0 {
+		config.LeaseTime = 12 * time.Hour
+	}
+
+	s := &DHCPServer{
+		endpoint: e,
+		config:   config,
+		leases:   make(map[string]*dhcpLease),
+		byIP:     make(map[string]*dhcpLease),
+	}
+
+	for mac, ip := range config.StaticHosts {
+		l := &dhcpLease{ip: ip, mac: mac, static: true}
+		s.leases[mac] = l
+		s.byIP[ip.String()] = l
+	}
+
+	s.cancel = e.AddPacketHandler(header.IPv4ProtocolNumber, s.handleFrame)
+	return s, nil
+}
+
+// Close unregisters the server from its LinkEndpoint.
+func (s *DHCPServer) Close() {
+	s.cancel()
+}
+
+func (s *DHCPServer) handleFrame(dir Direction, _ time.Time, conn *Conn, frame []byte) {
+	if dir != DirectionIngress || len(frame) < header.EthernetMinimumSize+header.IPv4MinimumSize {
+		return
+	}
+
+	ipBuf := frame[header.EthernetMinimumSize:]
+	ip := header.IPv4(ipBuf)
+	if ip.TransportProtocol() != header.UDPProtocolNumber || len(ipBuf) < int(ip.HeaderLength()) {
+		return
+	}
+
+	udpBuf := ipBuf[ip.HeaderLength():]
+	if len(udpBuf) < header.UDPMinimumSize {
+		return
+	}
+	udp := header.UDP(udpBuf)
+	if udp.DestinationPort() != dhcpServerPort {
+		return
+	}
+
+	req, err := parseDHCPMessage(udp.Payload())
+	if err != nil {
+		log.Error(errors.Wrap(err, "dhcp: malformed request"))
+		return
+	}
+
+	reply := s.handle(req)
+	if reply == nil {
+		return
+	}
+
+	// The reply always goes back out on the Conn the request arrived on -
+	// each client is its own switch port - so there's no need to consult
+	// the MAC table; broadcastL2 only affects the ethernet and IP
+	// destination addresses written into the frame (see send).
+	broadcastL2 := req.flags&dhcpFlagBroadcast != 0
+	if err := s.send(conn, broadcastL2, tcpip.LinkAddress(req.chaddr), reply); err != nil {
+		log.Error(errors.Wrap(err, "dhcp: cannot send reply"))
+	}
+}
+
+func (s *DHCPServer) handle(req *dhcpMessage) []byte {
+	mac := net.HardwareAddr(req.chaddr).String()
+
+	switch req.messageType() {
+	case dhcpDiscover:
+		l := s.leaseFor(mac, req.requestedIP())
+		if l == nil {
+			log.Warningf("dhcp: no free address for %s", mac)
+			return nil
+		}
+		return s.buildReply(dhcpOffer, req, l.ip)
+
+	case dhcpRequest:
+		reqIP := req.requestedIP()
+		if reqIP == nil {
+			reqIP = req.ciaddr
+		}
+		l := s.confirm(mac, reqIP)
+		if l == nil {
+			return s.buildReply(dhcpNak, req, net.IPv4zero)
+		}
+		return s.buildReply(dhcpAck, req, l.ip)
+
+	case dhcpDecline, dhcpRelease:
+		s.release(mac)
+		return nil
+
+	default:
+		return nil
+	}
+}
+
+func (s *DHCPServer) leaseFor(mac string, requested net.IP) *dhcpLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.leases[mac]; ok {
+		return l
+	}
+
+	if requested != nil && s.inRangeLocked(requested) && s.byIP[requested.String()] == nil {
+		return s.reserveLocked(mac, requested)
+	}
+
+	for v := ip2int(s.config.RangeStart); v <= ip2int(s.config.RangeEnd); v++ {
+		ip := int2ip(v)
+		if s.byIP[ip.String()] == nil {
+			return s.reserveLocked(mac, ip)
+		}
+	}
+	return nil
+}
+
+func (s *DHCPServer) confirm(mac string, ip net.IP) *dhcpLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leases[mac]
+	if !ok || ip == nil || !l.ip.Equal(ip) {
+		return nil
+	}
+	l.expires = time.Now().Add(s.config.LeaseTime)
+	return l
+}
+
+func (s *DHCPServer) release(mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leases[mac]
+	if !ok || l.static {
+		return
+	}
+	delete(s.leases, mac)
+	delete(s.byIP, l.ip.String())
+}
+
+func (s *DHCPServer) reserveLocked(mac string, ip net.IP) *dhcpLease {
+	l := &dhcpLease{ip: ip, mac: mac, expires: time.Now().Add(s.config.LeaseTime)}
+	s.leases[mac] = l
+	s.byIP[ip.String()] = l
+	return l
+}
+
+func (s *DHCPServer) inRangeLocked(ip net.IP) bool {
+	v := ip2int(ip)
+	return v >= ip2int(s.config.RangeStart) && v <= ip2int(s.config.RangeEnd)
+}
+
+func (s *DHCPServer) buildReply(msgType dhcpMessageType, req *dhcpMessage, yiaddr net.IP) []byte {
+	b := make([]byte, 240, 300)
+	b[0] = dhcpBootReply
+	b[1] = req.htype
+	b[2] = req.hlen
+	binary.BigEndian.PutUint32(b[4:8], req.xid)
+	binary.BigEndian.PutUint16(b[10:12], req.flags)
+	copy(b[16:20], yiaddr.To4())
+	copy(b[20:24], s.config.ServerIP.To4())
+	copy(b[24:28], req.giaddr.To4())
+	copy(b[28:28+len(req.chaddr)], req.chaddr)
+	binary.BigEndian.PutUint32(b[236:240], dhcpMagicCookie)
+
+	addOpt := func(code byte, data []byte) {
+		b = append(b, code, byte(len(data)))
+		b = append(b, data...)
+	}
+
+	addOpt(optMessageType, []byte{byte(msgType)})
+	addOpt(optServerID, s.config.ServerIP.To4())
+	if msgType != dhcpNak {
+		leaseBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(leaseBuf, uint32(s.config.LeaseTime.Seconds()))
+		addOpt(optLeaseTime, leaseBuf)
+		addOpt(optSubnetMask, net.IP(s.config.Netmask).To4())
+		addOpt(optRouter, s.config.Gateway.To4())
+		if len(s.config.DNS) > 0 {
+			dns := make([]byte, 0, 4*len(s.config.DNS))
+			for _, d := range s.config.DNS {
+				dns = append(dns, d.To4()...)
+			}
+			addOpt(optDNSServer, dns)
+		}
+	}
+	b = append(b, optEnd)
+	return b
+}
+
+// send wraps a DHCP reply in an Ethernet/IPv4/UDP frame and writes it to
+// conn using the endpoint's own (length-prefixed) socket framing.
+func (s *DHCPServer) send(conn *Conn, broadcastL2 bool, dstMAC tcpip.LinkAddress, payload []byte) error {
+	udpLen := header.UDPMinimumSize + len(payload)
+	ipLen := header.IPv4MinimumSize + udpLen
+
+	buf := make([]byte, header.EthernetMinimumSize+ipLen)
+
+	ethDst := dstMAC
+	if broadcastL2 {
+		ethDst = tcpip.LinkAddress(broadcastMAC)
+	}
+	header.Ethernet(buf).Encode(&header.EthernetFields{
+		SrcAddr: s.endpoint.Mac,
+		DstAddr: ethDst,
+		Type:    header.IPv4ProtocolNumber,
+	})
+
+	ipBuf := buf[header.EthernetMinimumSize:]
+	serverIP := s.config.ServerIP.To4()
+
+	// A client that set the broadcast flag (or one old enough not to
+	// accept a unicast reply before it's configured) gets an IP broadcast
+	// to match the ethernet broadcast above. Otherwise the reply can go
+	// straight to yiaddr, the address the client is being offered/given -
+	// RFC 2131 section 4.1 - rather than being sent as 255.255.255.255
+	// unconditionally.
+	dstIP := net.IPv4bcast.To4()
+	if !broadcastL2 {
+		if yiaddr := net.IP(payload[16:20]).To4(); !yiaddr.Equal(net.IPv4zero) {
+			dstIP = yiaddr
+		}
+	}
+
+	header.IPv4(ipBuf).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(ipLen),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address(serverIP),
+		DstAddr:     tcpip.Address(dstIP),
+	})
+	header.IPv4(ipBuf).SetChecksum(checksumFinish(checksumAdd(0, ipBuf[:header.IPv4MinimumSize])))
+
+	udpBuf := ipBuf[header.IPv4MinimumSize:]
+	header.UDP(udpBuf).Encode(&header.UDPFields{
+		SrcPort: dhcpServerPort,
+		DstPort: dhcpClientPort,
+		Length:  uint16(udpLen),
+	})
+	copy(udpBuf[header.UDPMinimumSize:], payload)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], serverIP)
+	copy(pseudo[4:8], dstIP)
+	pseudo[9] = uint8(header.UDPProtocolNumber)
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(udpLen))
+	header.UDP(udpBuf).SetChecksum(checksumFinish(checksumAdd(checksumAdd(0, pseudo), udpBuf)))
+
+	if s.endpoint.Debug || s.endpoint.hasPacketHandlers() {
+		if s.endpoint.Debug {
+			log.Info(gopacket.NewPacket(buf, layers.LayerTypeEthernet, gopacket.Default).String())
+		}
+		s.endpoint.dispatchToPacketHandlers(DirectionEgress, header.IPv4ProtocolNumber, conn, buf)
+	}
+
+	size := make([]byte, 2)
+	binary.LittleEndian.PutUint16(size, uint16(len(buf)))
+
+	if err := conn.write(net.Buffers{size, buf}, uint64(len(buf))); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.endpoint.Sent, uint64(len(buf)))
+	return nil
+}
+
+// dhcpMessage is a parsed DHCPv4 message (RFC 2131 section 2).
+type dhcpMessage struct {
+	htype   byte
+	hlen    byte
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	giaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func (m *dhcpMessage) messageType() dhcpMessageType {
+	if v, ok := m.options[optMessageType]; ok && len(v) == 1 {
+		return dhcpMessageType(v[0])
+	}
+	return 0
+}
+
+func (m *dhcpMessage) requestedIP() net.IP {
+	v, ok := m.options[optRequestedIP]
+	if !ok || len(v) != 4 {
+		return nil
+	}
+	return net.IP(v)
+}
+
+func parseDHCPMessage(b []byte) (*dhcpMessage, error) {
+	if len(b) < 240 {
+		return nil, fmt.Errorf("dhcp: packet too short (%d bytes)", len(b))
+	}
+	if b[0] != dhcpBootRequest {
+		return nil, fmt.Errorf("dhcp: not a BOOTREQUEST (op=%d)", b[0])
+	}
+	if binary.BigEndian.Uint32(b[236:240]) != dhcpMagicCookie {
+		return nil, errors.New("dhcp: bad magic cookie")
+	}
+
+	// Ethernet is the only link layer this endpoint supports, so the
+	// client hardware address is always the first 6 bytes of chaddr.
+	m := &dhcpMessage{
+		htype:   b[1],
+		hlen:    b[2],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		ciaddr:  net.IP(append([]byte{}, b[12:16]...)),
+		giaddr:  net.IP(append([]byte{}, b[24:28]...)),
+		chaddr:  net.HardwareAddr(append([]byte{}, b[28:34]...)),
+		options: make(map[byte][]byte),
+	}
+
+	opts := b[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == 0 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 {
+			break
+		}
+		l := int(opts[1])
+		if len(opts) < 2+l {
+			break
+		}
+		m.options[code] = opts[2 : 2+l]
+		opts = opts[2+l:]
+	}
+
+	return m, nil
+}
+
+func ip2int(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func int2ip(v uint32) net.IP {
+	b := make(net.IP, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFinish(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
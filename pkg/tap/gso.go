@@ -0,0 +1,129 @@
+package tap
+
+import (
+	"encoding/binary"
+	"net"
+
+	log "github.com/golang/glog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	tcpFlagFin = 0x01
+	tcpFlagPsh = 0x08
+)
+
+// writeGSOPacket splits a single GSO super-frame into gso.MSS-sized TCP
+// segments, duplicating and fixing up the IP/TCP headers (length, ID,
+// sequence number, flags, checksums) for each one, and writes every
+// segment out through the normal (possibly switched) per-frame path.
+//
+// Only IPv4/TCP segmentation is implemented. Anything else - IPv6, a GSO
+// type we don't recognise, or a template header too short to find a full
+// IP+TCP header in - is written whole via writeSingleFrame, same as before
+// GSO support landed; the peer's own stack has to cope with the
+// super-frame.
+func (e *LinkEndpoint) writeGSOPacket(r *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
+	if gso.Type != stack.GSOTCPv4 || protocol != header.IPv4ProtocolNumber || gso.MSS == 0 {
+		return e.writeSingleFrame(r, protocol, pkt)
+	}
+
+	// All of the fallbacks below must run before addEthernetHeader: pkt.Header
+	// doesn't carry a link header yet at this point, but writeSingleFrame
+	// prepends its own, so calling it after addEthernetHeader would double up
+	// the ethernet header on the wire.
+	l3 := pkt.Header.View()
+	if len(l3) < header.IPv4MinimumSize+header.TCPMinimumSize {
+		return e.writeSingleFrame(r, protocol, pkt)
+	}
+
+	ipHdrLen := int(header.IPv4(l3).HeaderLength())
+	if len(l3) < ipHdrLen+header.TCPMinimumSize {
+		return e.writeSingleFrame(r, protocol, pkt)
+	}
+
+	tcpHdrLen := 4 * int(l3[ipHdrLen+12]>>4)
+	l34Len := ipHdrLen + tcpHdrLen
+	if tcpHdrLen < header.TCPMinimumSize || len(l3) < l34Len {
+		return e.writeSingleFrame(r, protocol, pkt)
+	}
+
+	// The template header is well formed enough to segment, so it's now
+	// safe to commit to prepending the ethernet header.
+	e.addEthernetHeader(r, protocol, pkt)
+	full := pkt.Header.View()
+	ethHdr := full[:header.EthernetMinimumSize]
+	l34 := full[header.EthernetMinimumSize : header.EthernetMinimumSize+l34Len]
+
+	srcIP := append(net.IP{}, l34[12:16]...)
+	dstIP := append(net.IP{}, l34[16:20]...)
+	seq := binary.BigEndian.Uint32(l34[ipHdrLen+4 : ipHdrLen+8])
+	ipID := binary.BigEndian.Uint16(l34[4:6])
+	origFlags := l34[ipHdrLen+13]
+	midFlags := origFlags &^ (tcpFlagFin | tcpFlagPsh)
+
+	payload := pkt.Data.ToView()
+	mss := int(gso.MSS)
+
+	for off := 0; off == 0 || off < len(payload); off += mss {
+		end := off + mss
+		last := end >= len(payload)
+		if last {
+			end = len(payload)
+		}
+		segment := payload[off:end]
+
+		seg := make([]byte, l34Len+len(segment))
+		copy(seg, l34)
+		copy(seg[l34Len:], segment)
+
+		binary.BigEndian.PutUint16(seg[2:4], uint16(len(seg)))
+		binary.BigEndian.PutUint16(seg[4:6], ipID)
+		seg[10], seg[11] = 0, 0
+		binary.BigEndian.PutUint16(seg[10:12], checksumFinish(checksumAdd(0, seg[:ipHdrLen])))
+
+		binary.BigEndian.PutUint32(seg[ipHdrLen+4:ipHdrLen+8], seq)
+		if last {
+			seg[ipHdrLen+13] = origFlags
+		} else {
+			seg[ipHdrLen+13] = midFlags
+		}
+		seg[ipHdrLen+16], seg[ipHdrLen+17] = 0, 0
+
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:4], srcIP)
+		copy(pseudo[4:8], dstIP)
+		pseudo[9] = uint8(header.TCPProtocolNumber)
+		binary.BigEndian.PutUint16(pseudo[10:12], uint16(tcpHdrLen+len(segment)))
+		tcpCsum := checksumFinish(checksumAdd(checksumAdd(0, pseudo), seg[ipHdrLen:]))
+		binary.BigEndian.PutUint16(seg[ipHdrLen+16:ipHdrLen+18], tcpCsum)
+
+		frame := make([]byte, header.EthernetMinimumSize+len(seg))
+		copy(frame, ethHdr)
+		copy(frame[header.EthernetMinimumSize:], seg)
+
+		if e.Debug || e.hasPacketHandlers() {
+			if e.Debug {
+				log.Info(gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default).String())
+			}
+			e.dispatchToPacketHandlers(DirectionEgress, protocol, nil, frame)
+		}
+
+		size := make([]byte, 2)
+		binary.LittleEndian.PutUint16(size, uint16(len(frame)))
+		if err := e.writeFrame(r.RemoteLinkAddress, nil, net.Buffers{size, frame}, uint64(len(frame))); err != nil {
+			log.Error(errors.Wrap(err, "cannot send GSO segment"))
+			return tcpip.ErrAborted
+		}
+
+		seq += uint32(len(segment))
+		ipID++
+	}
+
+	return nil
+}
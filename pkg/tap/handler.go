@@ -0,0 +1,102 @@
+package tap
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// Direction indicates whether a frame observed by a PacketHandler was read
+// off the wire or written to it.
+type Direction int
+
+const (
+	DirectionIngress Direction = iota
+	DirectionEgress
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionIngress:
+		return "ingress"
+	case DirectionEgress:
+		return "egress"
+	default:
+		return "unknown"
+	}
+}
+
+// PacketHandler receives a copy of every ethernet frame, including the link
+// header, seen by a LinkEndpoint. conn is the client connection the frame
+// was read from for DirectionIngress. For DirectionEgress it is nil for
+// frames sent by the stack (which may be written out to more than one
+// client), and the destination Conn for DHCP server replies, which go to
+// a single client. Implementations must not retain frame beyond the call.
+type PacketHandler func(dir Direction, timestamp time.Time, conn *Conn, frame []byte)
+
+type packetHandlerEntry struct {
+	id    uint64
+	proto tcpip.NetworkProtocolNumber
+	fn    PacketHandler
+}
+
+// AddPacketHandler registers h to be called with a copy of every frame of
+// the given protocol seen by e, in both directions. Pass proto == 0 to
+// receive frames of every protocol. Calling the returned cancel func
+// unregisters h. Safe to call concurrently with traffic flowing through e.
+func (e *LinkEndpoint) AddPacketHandler(proto tcpip.NetworkProtocolNumber, h PacketHandler) (cancel func()) {
+	e.handlersLock.Lock()
+	id := e.nextHandlerID
+	e.nextHandlerID++
+	e.handlers = append(e.handlers, packetHandlerEntry{id: id, proto: proto, fn: h})
+	e.handlersLock.Unlock()
+
+	return func() {
+		e.handlersLock.Lock()
+		defer e.handlersLock.Unlock()
+		for i, entry := range e.handlers {
+			if entry.id == id {
+				e.handlers = append(e.handlers[:i], e.handlers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (e *LinkEndpoint) hasPacketHandlers() bool {
+	e.handlersLock.RLock()
+	defer e.handlersLock.RUnlock()
+	return len(e.handlers) > 0
+}
+
+// dispatchToPacketHandlers calls every registered handler whose protocol
+// matches proto (or which registered for proto == 0) with frame.
+//
+// The handlers are snapshotted under handlersLock and then called with it
+// released: a handler fn is free to call back into AddPacketHandler,
+// cancel an existing registration, or itself send a packet and end up
+// back in dispatchToPacketHandlers (e.g. the DHCP server replying from
+// inside its own ingress handler) - none of that may happen while still
+// holding the lock, since sync.RWMutex forbids recursive read-locking
+// and a pending writer would deadlock all of them.
+func (e *LinkEndpoint) dispatchToPacketHandlers(dir Direction, proto tcpip.NetworkProtocolNumber, conn *Conn, frame []byte) {
+	e.handlersLock.RLock()
+	handlers := append([]packetHandlerEntry(nil), e.handlers...)
+	e.handlersLock.RUnlock()
+
+	if len(handlers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var frameCopy []byte
+	for _, entry := range handlers {
+		if entry.proto != 0 && entry.proto != proto {
+			continue
+		}
+		if frameCopy == nil {
+			frameCopy = append([]byte(nil), frame...)
+		}
+		entry.fn(dir, now, conn, frameCopy)
+	}
+}
@@ -1,12 +1,14 @@
 package tap
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/google/gopacket"
@@ -18,6 +20,46 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+// defaultBatchSize is the number of packets coalesced into a single
+// conn.Write (or read off the wire) when LinkEndpoint.BatchSize is unset.
+// 32 keeps a batch's worth of full-MTU frames comfortably within the 64
+// KiB rx reader buffer below while still giving the batching a real
+// throughput win out of the box.
+const defaultBatchSize = 32
+
+// defaultMACTableTimeout is how long a learned MAC table entry survives
+// without being refreshed when LinkEndpoint.MACTableTimeout is unset.
+const defaultMACTableTimeout = 5 * time.Minute
+
+// Conn is one client connection to a LinkEndpoint, i.e. one virtual switch
+// port. Sent and Received track bytes written to and read from this
+// connection specifically, as opposed to LinkEndpoint's endpoint-wide
+// totals.
+type Conn struct {
+	Sent     uint64
+	Received uint64
+
+	conn      net.Conn
+	writeLock sync.Mutex
+}
+
+func (c *Conn) write(bufs net.Buffers, payloadBytes uint64) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if _, err := bufs.WriteTo(c.conn); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.Sent, payloadBytes)
+	return nil
+}
+
+// macEntry records which Conn a MAC address was last learned from.
+type macEntry struct {
+	conn     *Conn
+	lastSeen time.Time
+}
+
 type LinkEndpoint struct {
 	Sent     uint64
 	Received uint64
@@ -27,12 +69,26 @@ type LinkEndpoint struct {
 	Mac                 tcpip.LinkAddress
 	MaxTransmissionUnit int
 
-	conn     net.Conn
-	connLock sync.Mutex
+	// BatchSize is the maximum number of packets coalesced into a single
+	// writev (on the tx path) or read in one pass before being handed to
+	// the dispatcher (on the rx path). Values <= 0 use defaultBatchSize.
+	BatchSize int
+
+	// MACTableTimeout bounds how long a learned source-MAC-to-Conn entry
+	// is kept without being refreshed. Values <= 0 default to 5 minutes.
+	MACTableTimeout time.Duration
+
+	connsLock sync.Mutex
+	conns     map[*Conn]struct{}
+
+	macTableLock sync.RWMutex
+	macTable     map[tcpip.LinkAddress]*macEntry
 
 	dispatcher stack.NetworkDispatcher
 
-	writeLock sync.Mutex
+	handlersLock  sync.RWMutex
+	handlers      []packetHandlerEntry
+	nextHandlerID uint64
 }
 
 func (e *LinkEndpoint) AddHeader(local, remote tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
@@ -47,7 +103,7 @@ func (e *LinkEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
 }
 
 func (e *LinkEndpoint) Capabilities() stack.LinkEndpointCapabilities {
-	return stack.CapabilityResolutionRequired | stack.CapabilityRXChecksumOffload
+	return stack.CapabilityResolutionRequired | stack.CapabilityRXChecksumOffload | stack.CapabilitySoftwareGSO
 }
 
 func (e *LinkEndpoint) IsAttached() bool {
@@ -69,13 +125,137 @@ func (e *LinkEndpoint) MTU() uint32 {
 func (e *LinkEndpoint) Wait() {
 }
 
-func (e *LinkEndpoint) WritePackets(r *stack.Route, gso *stack.GSO, pkts stack.PacketBufferList, protocol tcpip.NetworkProtocolNumber) (int, *tcpip.Error) {
-	return 1, tcpip.ErrNoRoute
+func (e *LinkEndpoint) batchSize() int {
+	if e.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return e.BatchSize
 }
 
-func (e *LinkEndpoint) WritePacket(r *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
+func (e *LinkEndpoint) macTableTimeout() time.Duration {
+	if e.MACTableTimeout <= 0 {
+		return defaultMACTableTimeout
+	}
+	return e.MACTableTimeout
+}
+
+// Conns returns a snapshot of the clients currently connected to e.
+func (e *LinkEndpoint) Conns() []*Conn {
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	out := make([]*Conn, 0, len(e.conns))
+	for c := range e.conns {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (e *LinkEndpoint) addConn(nc net.Conn) *Conn {
+	c := &Conn{conn: nc}
+
+	e.connsLock.Lock()
+	if e.conns == nil {
+		e.conns = make(map[*Conn]struct{})
+	}
+	e.conns[c] = struct{}{}
+	e.connsLock.Unlock()
+
+	return c
+}
+
+// dropConn evicts c from the connection set and MAC table and closes its
+// socket. Safe to call more than once for the same Conn.
+func (e *LinkEndpoint) dropConn(c *Conn) {
+	e.connsLock.Lock()
+	delete(e.conns, c)
+	e.connsLock.Unlock()
+
+	e.macTableLock.Lock()
+	for mac, entry := range e.macTable {
+		if entry.conn == c {
+			delete(e.macTable, mac)
+		}
+	}
+	e.macTableLock.Unlock()
+
+	c.conn.Close()
+}
+
+// learn records that mac was last seen arriving on c.
+func (e *LinkEndpoint) learn(mac tcpip.LinkAddress, c *Conn) {
+	if mac == "" || isBroadcastOrMulticast(mac) {
+		return
+	}
+
+	e.macTableLock.Lock()
+	if e.macTable == nil {
+		e.macTable = make(map[tcpip.LinkAddress]*macEntry)
+	}
+	e.macTable[mac] = &macEntry{conn: c, lastSeen: time.Now()}
+	e.macTableLock.Unlock()
+}
+
+// lookup returns the Conn mac was last learned from, or nil if it isn't
+// known or its entry has gone stale.
+func (e *LinkEndpoint) lookup(mac tcpip.LinkAddress) *Conn {
+	e.macTableLock.RLock()
+	entry, ok := e.macTable[mac]
+	e.macTableLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	if time.Since(entry.lastSeen) > e.macTableTimeout() {
+		e.macTableLock.Lock()
+		if e.macTable[mac] == entry {
+			delete(e.macTable, mac)
+		}
+		e.macTableLock.Unlock()
+		return nil
+	}
+	return entry.conn
+}
+
+// targets resolves the Conns a frame addressed to dst should be delivered
+// to, excluding except (typically the Conn the frame arrived on). A known
+// unicast destination resolves to the single Conn it was learned from;
+// broadcast, multicast and unknown unicast destinations flood to every
+// other connected Conn, matching standard learning-bridge semantics.
+func (e *LinkEndpoint) targets(dst tcpip.LinkAddress, except *Conn) []*Conn {
+	if !isBroadcastOrMulticast(dst) {
+		if c := e.lookup(dst); c != nil {
+			if c == except {
+				return nil
+			}
+			return []*Conn{c}
+		}
+	}
+
+	e.connsLock.Lock()
+	defer e.connsLock.Unlock()
+
+	out := make([]*Conn, 0, len(e.conns))
+	for c := range e.conns {
+		if c == except {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func isBroadcastOrMulticast(mac tcpip.LinkAddress) bool {
+	if mac == tcpip.LinkAddress(broadcastMAC) {
+		return true
+	}
+	return len(mac) == 6 && mac[0]&0x1 != 0
+}
+
+// addEthernetHeader prepends the ethernet header for pkt, following the
+// route's link addresses (or e.Mac if the route has none of its own).
+func (e *LinkEndpoint) addEthernetHeader(r *stack.Route, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
 	hdr := pkt.Header
-	payload := pkt.Data
 	eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
 	ethHdr := &header.EthernetFields{
 		DstAddr: r.RemoteLinkAddress,
@@ -89,53 +269,153 @@ func (e *LinkEndpoint) WritePacket(r *stack.Route, gso *stack.GSO, protocol tcpi
 		ethHdr.SrcAddr = e.Mac
 	}
 	eth.Encode(ethHdr)
+}
 
-	if e.Debug {
-		packet := gopacket.NewPacket(append(hdr.View(), payload.ToView()...), layers.LayerTypeEthernet, gopacket.Default)
-		log.Info(packet.String())
+// WritePackets writes up to e.BatchSize frames per underlying socket write
+// when there is exactly one connected client, coalescing the
+// length-prefixed frames into a single net.Buffers flush. With zero or
+// multiple clients, each packet may route to a different Conn, so frames
+// are written (and switched) individually. A GSO super-frame is segmented
+// first - see writeGSOPacket - bypassing the batching path entirely, since
+// it already expands to more than one frame on the wire.
+func (e *LinkEndpoint) WritePackets(r *stack.Route, gso *stack.GSO, pkts stack.PacketBufferList, protocol tcpip.NetworkProtocolNumber) (int, *tcpip.Error) {
+	if gso != nil && gso.Type != stack.GSONone {
+		n := 0
+		for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+			if err := e.writeGSOPacket(r, gso, protocol, pkt); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, nil
 	}
 
-	if err := e.writeSockets(hdr, payload); err != nil {
-		log.Error(errors.Wrap(err, "cannot send packets"))
-		return tcpip.ErrAborted
+	batch := e.batchSize()
+
+	var sole *Conn
+	if conns := e.Conns(); len(conns) == 1 {
+		sole = conns[0]
 	}
-	return nil
-}
 
-func (e *LinkEndpoint) writeSockets(hdr buffer.Prependable, payload buffer.VectorisedView) error {
-	size := make([]byte, 2)
-	binary.LittleEndian.PutUint16(size, uint16(hdr.UsedLength()+payload.Size()))
+	n := 0
+	bufs := make(net.Buffers, 0, 3*batch)
+	var payloadBytes uint64
+
+	flush := func() *tcpip.Error {
+		if len(bufs) == 0 {
+			return nil
+		}
+		if err := sole.write(bufs, payloadBytes); err != nil {
+			e.dropConn(sole)
+			log.Error(errors.Wrap(err, "cannot send packets"))
+			bufs = bufs[:0]
+			payloadBytes = 0
+			return tcpip.ErrAborted
+		}
+		atomic.AddUint64(&e.Sent, payloadBytes)
+		bufs = bufs[:0]
+		payloadBytes = 0
+		return nil
+	}
 
-	e.writeLock.Lock()
-	defer e.writeLock.Unlock()
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		e.addEthernetHeader(r, protocol, pkt)
 
-	e.connLock.Lock()
-	defer e.connLock.Unlock()
+		hdr := pkt.Header
+		payload := pkt.Data
+		frameLen := hdr.UsedLength() + payload.Size()
 
-	if e.conn == nil {
-		return nil
+		if e.Debug || e.hasPacketHandlers() {
+			frame := append(hdr.View(), payload.ToView()...)
+			if e.Debug {
+				log.Info(gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default).String())
+			}
+			e.dispatchToPacketHandlers(DirectionEgress, protocol, nil, frame)
+		}
+
+		size := make([]byte, 2)
+		binary.LittleEndian.PutUint16(size, uint16(frameLen))
+		n++
+
+		if sole != nil {
+			bufs = append(bufs, size, hdr.View(), payload.ToView())
+			payloadBytes += uint64(frameLen)
+			if len(bufs) >= 3*batch {
+				if err := flush(); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+
+		if err := e.writeFrame(r.RemoteLinkAddress, nil, net.Buffers{size, hdr.View(), payload.ToView()}, uint64(frameLen)); err != nil {
+			log.Error(errors.Wrap(err, "cannot send packets"))
+			return n, tcpip.ErrAborted
+		}
 	}
 
-	if _, err := e.conn.Write(size); err != nil {
-		e.conn.Close()
-		e.conn = nil
-		return err
+	if err := flush(); err != nil {
+		return n, err
 	}
-	if _, err := e.conn.Write(hdr.View()); err != nil {
-		e.conn.Close()
-		e.conn = nil
-		return err
+
+	return n, nil
+}
+
+func (e *LinkEndpoint) WritePacket(r *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
+	if gso != nil && gso.Type != stack.GSONone {
+		return e.writeGSOPacket(r, gso, protocol, pkt)
 	}
-	if _, err := e.conn.Write(payload.ToView()); err != nil {
-		e.conn.Close()
-		e.conn = nil
-		return err
+	return e.writeSingleFrame(r, protocol, pkt)
+}
+
+// writeSingleFrame writes pkt out as one ethernet frame, with no GSO
+// segmentation. It's the path WritePacket takes for non-GSO sends, and
+// also what writeGSOPacket falls back to when it can't segment a
+// particular super-frame itself.
+func (e *LinkEndpoint) writeSingleFrame(r *stack.Route, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
+	e.addEthernetHeader(r, protocol, pkt)
+
+	hdr := pkt.Header
+	payload := pkt.Data
+	frameLen := hdr.UsedLength() + payload.Size()
+
+	if e.Debug || e.hasPacketHandlers() {
+		frame := append(hdr.View(), payload.ToView()...)
+		if e.Debug {
+			log.Info(gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default).String())
+		}
+		e.dispatchToPacketHandlers(DirectionEgress, protocol, nil, frame)
 	}
 
-	atomic.AddUint64(&e.Sent, uint64(hdr.UsedLength()+payload.Size()))
+	size := make([]byte, 2)
+	binary.LittleEndian.PutUint16(size, uint16(frameLen))
+
+	if err := e.writeFrame(r.RemoteLinkAddress, nil, net.Buffers{size, hdr.View(), payload.ToView()}, uint64(frameLen)); err != nil {
+		log.Error(errors.Wrap(err, "cannot send packets"))
+		return tcpip.ErrAborted
+	}
 	return nil
 }
 
+// writeFrame delivers a length-prefixed frame to every Conn that dst routes
+// to (see targets), skipping except. Each target gets its own copy of
+// bufs, since net.Buffers.WriteTo consumes the slice it's handed.
+func (e *LinkEndpoint) writeFrame(dst tcpip.LinkAddress, except *Conn, bufs net.Buffers, payloadBytes uint64) error {
+	var firstErr error
+	for _, c := range e.targets(dst, except) {
+		cbufs := append(net.Buffers{}, bufs...)
+		if err := c.write(cbufs, payloadBytes); err != nil {
+			e.dropConn(c)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		atomic.AddUint64(&e.Sent, payloadBytes)
+	}
+	return firstErr
+}
+
 func (e *LinkEndpoint) WriteRawPacket(vv buffer.VectorisedView) *tcpip.Error {
 	return tcpip.ErrNoRoute
 }
@@ -143,71 +423,118 @@ func (e *LinkEndpoint) WriteRawPacket(vv buffer.VectorisedView) *tcpip.Error {
 func (e *LinkEndpoint) AcceptOne() error {
 	log.Info("waiting for packets...")
 	for {
-		conn, err := e.Listener.Accept()
+		nc, err := e.Listener.Accept()
 		if err != nil {
 			return errors.Wrap(err, "cannot accept new client")
 		}
-		e.connLock.Lock()
-		e.conn = conn
-		e.connLock.Unlock()
+		c := e.addConn(nc)
 		go func() {
-			defer func() {
-				e.connLock.Lock()
-				e.conn = nil
-				e.connLock.Unlock()
-				conn.Close()
-			}()
-			if err := rx(conn, e); err != nil {
+			defer e.dropConn(c)
+			if err := rx(c, e); err != nil {
 				log.Error(errors.Wrap(err, "cannot receive packets"))
-				return
 			}
 		}()
 	}
 }
 
-func rx(conn net.Conn, e *LinkEndpoint) error {
+// forward switches frame - addressed to someone other than e.Mac - out to
+// its learned owner, or floods it to every other client when the
+// destination is broadcast, multicast, or not yet learned. The Conn frame
+// arrived on (ingress) is always excluded.
+func (e *LinkEndpoint) forward(ingress *Conn, frame []byte) {
+	targets := e.targets(header.Ethernet(frame).DestinationAddress(), ingress)
+	if len(targets) == 0 {
+		return
+	}
+
+	size := make([]byte, 2)
+	binary.LittleEndian.PutUint16(size, uint16(len(frame)))
+
+	for _, c := range targets {
+		if err := c.write(net.Buffers{size, frame}, uint64(len(frame))); err != nil {
+			e.dropConn(c)
+			continue
+		}
+		atomic.AddUint64(&e.Sent, uint64(len(frame)))
+	}
+}
+
+// rx reads frames off c and both dispatches them into e's stack and, for
+// frames not addressed to e.Mac, switches them out to whichever other
+// client owns (or might own) the destination MAC - see forward. Reads are
+// buffered so that up to e.BatchSize frames already sitting in the kernel
+// socket buffer are drained before the next blocking Read. Each frame gets
+// its own freshly allocated buffer: e.dispatcher does not copy, so a
+// pooled/reused buffer would risk overwriting data a TCP receive queue is
+// still holding onto.
+func rx(c *Conn, e *LinkEndpoint) error {
+	batch := e.batchSize()
+	r := bufio.NewReaderSize(c.conn, 64*1024)
 	sizeBuf := make([]byte, 2)
 
 	for {
-		n, err := io.ReadFull(conn, sizeBuf)
-		if err != nil {
-			return errors.Wrap(err, "cannot read size from socket")
-		}
-		if n != 2 {
-			return fmt.Errorf("unexpected size %d", n)
-		}
-		size := int(binary.LittleEndian.Uint16(sizeBuf[0:2]))
+		for i := 0; i < batch; i++ {
+			n, err := io.ReadFull(r, sizeBuf)
+			if err != nil {
+				return errors.Wrap(err, "cannot read size from socket")
+			}
+			if n != 2 {
+				return fmt.Errorf("unexpected size %d", n)
+			}
+			size := int(binary.LittleEndian.Uint16(sizeBuf[0:2]))
 
-		buf := make([]byte, e.MaxTransmissionUnit+header.EthernetMinimumSize)
-		n, err = io.ReadFull(conn, buf[:size])
-		if err != nil {
-			return errors.Wrap(err, "cannot read packet from socket")
-		}
-		if n == 0 || n != size {
-			return fmt.Errorf("unexpected size %d != %d", n, size)
-		}
+			// buf is handed to e.dispatcher below, which does not copy -
+			// netstack keeps shallow views into it (e.g. a TCP receive
+			// queue) well after this function moves on. It must not be
+			// reused or pooled; allocate a fresh one per frame.
+			buf := make([]byte, size)
 
-		if e.Debug {
-			packet := gopacket.NewPacket(buf[:size], layers.LayerTypeEthernet, gopacket.Default)
-			log.Info(packet.String())
-		}
+			n, err = io.ReadFull(r, buf)
+			if err != nil {
+				return errors.Wrap(err, "cannot read packet from socket")
+			}
+			if n == 0 || n != size {
+				return fmt.Errorf("unexpected size %d != %d", n, size)
+			}
 
-		view := buffer.View(buf[:size])
-		eth := header.Ethernet(view)
-		vv := buffer.NewVectorisedView(len(view), []buffer.View{view})
-		vv.TrimFront(header.EthernetMinimumSize)
+			if e.Debug {
+				packet := gopacket.NewPacket(buf, layers.LayerTypeEthernet, gopacket.Default)
+				log.Info(packet.String())
+			}
 
-		if e.dispatcher == nil {
-			continue
+			view := buffer.View(buf)
+			eth := header.Ethernet(view)
+
+			e.learn(eth.SourceAddress(), c)
+
+			if e.hasPacketHandlers() {
+				e.dispatchToPacketHandlers(DirectionIngress, eth.Type(), c, buf)
+			}
+
+			if eth.DestinationAddress() != e.Mac {
+				e.forward(c, buf)
+			}
+
+			vv := buffer.NewVectorisedView(len(view), []buffer.View{view})
+			vv.TrimFront(header.EthernetMinimumSize)
+
+			atomic.AddUint64(&c.Received, uint64(size))
+
+			if e.dispatcher != nil {
+				atomic.AddUint64(&e.Received, uint64(size))
+				e.dispatcher.DeliverNetworkPacket(
+					eth.SourceAddress(),
+					eth.DestinationAddress(),
+					eth.Type(),
+					&stack.PacketBuffer{
+						Data: vv,
+					},
+				)
+			}
+
+			if r.Buffered() == 0 {
+				break
+			}
 		}
-		atomic.AddUint64(&e.Received, uint64(size))
-		e.dispatcher.DeliverNetworkPacket(
-			eth.SourceAddress(),
-			eth.DestinationAddress(),
-			eth.Type(),
-			&stack.PacketBuffer{
-				Data: vv,
-			},
-		)
 	}
 }
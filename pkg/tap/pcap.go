@@ -0,0 +1,57 @@
+package tap
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pcapMagicNumber      = 0xa1b2c3d4
+	pcapVersionMajor     = 2
+	pcapVersionMinor     = 4
+	pcapSnapLen          = 65535
+	pcapLinkTypeEthernet = 1
+)
+
+// NewPCAPWriter returns a PacketHandler that writes every frame it is given
+// to w in pcap format, so the capture can be read back with e.g.
+// `tcpdump -r`. Register it with LinkEndpoint.AddPacketHandler and proto ==
+// 0 to capture all traffic. Safe for concurrent use.
+//
+// cmd/gvproxy's -pcap flag opens the file and wires this up at startup.
+func NewPCAPWriter(w io.Writer) (PacketHandler, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNumber)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeEthernet)
+
+	if _, err := w.Write(hdr); err != nil {
+		return nil, errors.Wrap(err, "cannot write pcap header")
+	}
+
+	var mu sync.Mutex
+	recHdr := make([]byte, 16)
+
+	return func(dir Direction, timestamp time.Time, conn *Conn, frame []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		binary.LittleEndian.PutUint32(recHdr[0:4], uint32(timestamp.Unix()))
+		binary.LittleEndian.PutUint32(recHdr[4:8], uint32(timestamp.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(recHdr[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(recHdr[12:16], uint32(len(frame)))
+
+		if _, err := w.Write(recHdr); err != nil {
+			return
+		}
+		// Best effort: a pcap reader tolerates a truncated file but we
+		// can't surface a write error through the PacketHandler signature.
+		_, _ = w.Write(frame)
+	}, nil
+}